@@ -0,0 +1,312 @@
+package gather
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format selects how gathered dependencies are written out.
+type Format string
+
+const (
+	// FormatDir writes every dependency into a directory tree, mirroring its resolved absolute path.
+	FormatDir Format = "dir"
+	// FormatTar writes a single uncompressed tar archive.
+	FormatTar Format = "tar"
+	// FormatTarGz writes a single gzip compressed tar archive.
+	FormatTarGz Format = "tar.gz"
+	// FormatCPIO writes a single cpio (newc) archive.
+	FormatCPIO Format = "cpio"
+	// FormatOCILayer writes a gzip compressed tar archive alongside an OCI layer descriptor.
+	FormatOCILayer Format = "oci-layer"
+)
+
+// archiveEpoch is used as the mtime of every archive entry, so archives built from the same dependency
+// set are byte-for-byte reproducible regardless of when they were built.
+var archiveEpoch = time.Unix(0, 0).UTC()
+
+// archiveEntry is a single file or symlink to be written to an archive or output directory.
+type archiveEntry struct {
+	// Name is the absolute path the entry is stored under.
+	Name string
+	Mode os.FileMode
+	// LinkTarget is set for symlink entries, e.g. libfoo.so.1 -> libfoo.so.1.2.3; SourcePath is then empty.
+	LinkTarget string
+	// SourcePath is the FS path to read the entry's content from. Empty for symlink entries.
+	SourcePath string
+}
+
+// archiveEntries expands deps into the files and SONAME symlinks that need to be written, deduplicated
+// and sorted by name for reproducible output. A dependency whose resolved path is itself a symlink on the
+// host (the common case for a versioned SONAME such as libfoo.so.1 -> libfoo.so.1.2.3) keeps that symlink
+// instead of flattening it into a copy of the target's content.
+func (g *Gatherer) archiveEntries(deps []Dep) ([]archiveEntry, error) {
+	seen := make(map[string]bool)
+	entries := make([]archiveEntry, 0, len(deps))
+
+	for _, dep := range deps {
+		if target, ok := g.readlink(dep.Path); ok {
+			realPath := target
+			if !filepath.IsAbs(realPath) {
+				realPath = filepath.Join(filepath.Dir(dep.Path), realPath)
+			}
+
+			if !seen[realPath] {
+				seen[realPath] = true
+				info, err := fs.Stat(g.FS, toFSPath(realPath))
+				if err != nil {
+					return nil, fmt.Errorf("Could not stat %q: %v", realPath, err)
+				}
+				entries = append(entries, archiveEntry{Name: realPath, Mode: info.Mode(), SourcePath: realPath})
+			}
+
+			if !seen[dep.Path] {
+				seen[dep.Path] = true
+				entries = append(entries, archiveEntry{Name: dep.Path, Mode: os.ModeSymlink | 0777, LinkTarget: filepath.Base(realPath)})
+			}
+			continue
+		}
+
+		if seen[dep.Path] {
+			continue
+		}
+		seen[dep.Path] = true
+
+		info, err := fs.Stat(g.FS, toFSPath(dep.Path))
+		if err != nil {
+			return nil, fmt.Errorf("Could not stat %q: %v", dep.Path, err)
+		}
+		entries = append(entries, archiveEntry{Name: dep.Path, Mode: info.Mode(), SourcePath: dep.Path})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// readlink resolves path's symlink target through g.FS if it implements SymlinkFS, reporting ok == false
+// if g.FS doesn't support it or path isn't a symlink.
+func (g *Gatherer) readlink(path string) (target string, ok bool) {
+	sfs, implemented := g.FS.(SymlinkFS)
+	if !implemented {
+		return "", false
+	}
+
+	target, err := sfs.Readlink(toFSPath(path))
+	if err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+/* ############################################## */
+/* ###               Tar / Tar.gz             ### */
+/* ############################################## */
+
+// WriteTar streams deps as an uncompressed tar archive to w.
+func (g *Gatherer) WriteTar(deps []Dep, w io.Writer) error {
+	entries, err := g.archiveEntries(deps)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := g.writeTarEntry(tw, e); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (g *Gatherer) writeTarEntry(tw *tar.Writer, e archiveEntry) error {
+	name := strings.TrimPrefix(e.Name, "/")
+
+	if len(e.LinkTarget) > 0 {
+		return tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeSymlink,
+			Linkname: e.LinkTarget,
+			Mode:     int64(e.Mode.Perm()),
+			ModTime:  archiveEpoch,
+		})
+	}
+
+	f, err := g.FS.Open(toFSPath(e.SourcePath))
+	if err != nil {
+		return fmt.Errorf("Could not open %q: %v", e.SourcePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Could not stat %q: %v", e.SourcePath, err)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(e.Mode.Perm()),
+		Size:     info.Size(),
+		ModTime:  archiveEpoch,
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// WriteTarGz streams deps as a gzip compressed tar archive to w.
+func (g *Gatherer) WriteTarGz(deps []Dep, w io.Writer) error {
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	gz.ModTime = archiveEpoch
+
+	if err := g.WriteTar(deps, gz); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+/* ############################################## */
+/* ###                  CPIO                  ### */
+/* ############################################## */
+
+const (
+	cpioModeReg = 0100000
+	cpioModeLnk = 0120000
+)
+
+// WriteCPIO streams deps as a "newc" (SVR4 no CRC) cpio archive to w.
+func (g *Gatherer) WriteCPIO(deps []Dep, w io.Writer) error {
+	entries, err := g.archiveEntries(deps)
+	if err != nil {
+		return err
+	}
+
+	ino := uint32(1)
+	for _, e := range entries {
+		if err := g.writeCPIOEntry(w, e, ino); err != nil {
+			return err
+		}
+		ino++
+	}
+	return writeCPIOHeader(w, ino, 0, "TRAILER!!!", 0, bytes.NewReader(nil))
+}
+
+func (g *Gatherer) writeCPIOEntry(w io.Writer, e archiveEntry, ino uint32) error {
+	name := strings.TrimPrefix(e.Name, "/")
+
+	if len(e.LinkTarget) > 0 {
+		data := []byte(e.LinkTarget)
+		return writeCPIOHeader(w, ino, cpioModeLnk|uint32(e.Mode.Perm()), name, int64(len(data)), bytes.NewReader(data))
+	}
+
+	f, err := g.FS.Open(toFSPath(e.SourcePath))
+	if err != nil {
+		return fmt.Errorf("Could not open %q: %v", e.SourcePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Could not stat %q: %v", e.SourcePath, err)
+	}
+
+	return writeCPIOHeader(w, ino, cpioModeReg|uint32(e.Mode.Perm()), name, info.Size(), f)
+}
+
+// writeCPIOHeader writes a single newc header, name and content (read fully from r, size bytes), applying
+// the 4-byte alignment padding the format requires after the header+name and after the content.
+func writeCPIOHeader(w io.Writer, ino, mode uint32, name string, size int64, r io.Reader) error {
+	nameSize := len(name) + 1 // includes the trailing NUL
+
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		ino, mode, 0, 0, 1, 0, size, 0, 0, 0, 0, nameSize, 0)
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, name+"\x00"); err != nil {
+		return err
+	}
+	if err := writeCPIOPadding(w, int64(len(header)+nameSize)); err != nil {
+		return err
+	}
+
+	written, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("Short read for %q: expected %d bytes, got %d", name, size, written)
+	}
+	return writeCPIOPadding(w, size)
+}
+
+func writeCPIOPadding(w io.Writer, n int64) error {
+	if pad := (4 - n%4) % 4; pad > 0 {
+		_, err := w.Write(make([]byte, pad))
+		return err
+	}
+	return nil
+}
+
+/* ############################################## */
+/* ###                OCI Layer               ### */
+/* ############################################## */
+
+// OCILayerDescriptor describes a gzip compressed tar layer as used in an OCI image manifest.
+type OCILayerDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffId"`
+	Size      int64  `json:"size"`
+}
+
+// WriteOCILayer streams deps as a gzip compressed tar layer to w and returns its descriptor (digest of the
+// compressed bytes, diffID of the uncompressed tar, and compressed size) for a sidecar layer.json.
+func (g *Gatherer) WriteOCILayer(deps []Dep, w io.Writer) (*OCILayerDescriptor, error) {
+	digest := sha256.New()
+	diffID := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(w, digest)}
+
+	gz, _ := gzip.NewWriterLevel(counter, gzip.BestCompression)
+	gz.ModTime = archiveEpoch
+
+	if err := g.WriteTar(deps, io.MultiWriter(gz, diffID)); err != nil {
+		gz.Close()
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return &OCILayerDescriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Digest:    "sha256:" + hex.EncodeToString(digest.Sum(nil)),
+		DiffID:    "sha256:" + hex.EncodeToString(diffID.Sum(nil)),
+		Size:      counter.n,
+	}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
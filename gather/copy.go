@@ -0,0 +1,50 @@
+package gather
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WritableFS is the destination of a Copy, modeled after afero's Fs so callers can gather straight into a
+// directory, an archive writer, or an in-memory filesystem in tests.
+type WritableFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	Create(name string) (io.WriteCloser, error)
+}
+
+// Copy reads every dependency from the Gatherer's FS and writes it to outFS at its resolved path.
+func (g *Gatherer) Copy(deps []Dep, outFS WritableFS) error {
+	for _, dep := range deps {
+		if err := g.copyOne(dep, outFS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Gatherer) copyOne(dep Dep, outFS WritableFS) error {
+	g.logger().Infof("-> Gather file %q", dep.Path)
+
+	if err := outFS.MkdirAll(filepath.Dir(dep.Path), os.ModePerm); err != nil {
+		return fmt.Errorf("Could not create parent directory for %q: %v", dep.Path, err)
+	}
+
+	src, err := g.FS.Open(toFSPath(dep.Path))
+	if err != nil {
+		return fmt.Errorf("Could not open %q: %v", dep.Path, err)
+	}
+	defer src.Close()
+
+	dst, err := outFS.Create(dep.Path)
+	if err != nil {
+		return fmt.Errorf("Could not create %q: %v", dep.Path, err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("Failed to copy %q: %v", dep.Path, err)
+	}
+	return nil
+}
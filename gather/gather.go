@@ -0,0 +1,477 @@
+// Package gather resolves and copies the transitive shared library dependencies of an ELF binary, so it
+// can be embedded into other tools (build systems, container image builders, installers) instead of only
+// being usable as the gather-dependencies CLI.
+package gather
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sbreitf1/exec"
+)
+
+// Mode selects how NEEDED entries are discovered from a binary.
+type Mode string
+
+const (
+	// ModeLDD shells out to 'ldd'.
+	ModeLDD Mode = "LDD"
+	// ModeReadELF shells out to 'readelf -d'.
+	ModeReadELF Mode = "ReadELF"
+	// ModeParse reads the ELF dynamic section directly via debug/elf.
+	ModeParse Mode = "Parse"
+)
+
+// FindMode selects how a NEEDED entry is turned into an absolute library path.
+type FindMode string
+
+const (
+	// FindModeLD asks 'ldconfig -p' for the library cache.
+	FindModeLD FindMode = "LD"
+	// FindModeSearch follows the glibc dynamic-linker search order without relying on ldconfig.
+	FindModeSearch FindMode = "Search"
+)
+
+const (
+	patternLibName = "[a-zA-Z0-9.\\-_+]+"
+	patternLibPath = "[a-zA-Z0-9.\\-_+/]+"
+)
+
+// MachineType uniquely identifies the ELF platform a binary or library was built for, so libraries can be
+// matched against the binary that requires them instead of only distinguishing 32-bit from 64-bit.
+type MachineType struct {
+	Class   elf.Class
+	Data    elf.Data
+	Machine elf.Machine
+	OSABI   elf.OSABI
+}
+
+// String returns a human readable representation of the machine type as used in log output.
+func (t MachineType) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", t.Class, t.Data, t.Machine, t.OSABI)
+}
+
+// Dep is a single resolved dependency.
+type Dep struct {
+	// Path is the resolved absolute path of the dependency within the Gatherer's FS.
+	Path string
+}
+
+// Logger receives progress information from a Gatherer. *logrus.Logger satisfies it.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, args ...interface{}) {}
+func (nopLogger) Warnf(format string, args ...interface{}) {}
+
+// Resolver turns a NEEDED entry into an absolute path within fsys. callerFile is the binary or library
+// that declared the NEEDED entry.
+type Resolver interface {
+	FindLibrary(fsys fs.FS, machine MachineType, name, callerFile string) (string, error)
+}
+
+// Gatherer resolves and copies the transitive shared library dependencies of an ELF binary.
+type Gatherer struct {
+	// Mode selects how NEEDED entries are read from a binary. Defaults to ModeReadELF.
+	Mode Mode
+	// FindMode selects how a NEEDED entry is resolved to an absolute path. Defaults to FindModeLD.
+	FindMode FindMode
+	// MachineType is the platform dependencies are matched against.
+	MachineType MachineType
+	// FS is the filesystem binaries and libraries are read from. ModeLDD and ModeReadELF shell out to
+	// host tools and therefore still require FS to be backed by the real host filesystem; ModeParse and
+	// FindModeSearch work against any fs.FS, e.g. an unpacked container rootfs. Implementing SymlinkFS
+	// additionally lets archive output keep versioned SONAME symlinks instead of flattening them.
+	FS fs.FS
+	// Resolver is used for FindModeSearch. Ignored for FindModeLD, which always queries 'ldconfig -p'.
+	Resolver Resolver
+	// Log receives progress information. Defaults to discarding it.
+	Log Logger
+	// Jobs is the number of dependencies resolved concurrently. Defaults to 1.
+	Jobs int
+
+	// depsFunc overrides g.dependencies when set, so tests can drive dependenciesRecursive's worker pool
+	// without needing real ELF binaries or host tools.
+	depsFunc func(file string) ([]string, error)
+}
+
+func (g *Gatherer) logger() Logger {
+	if g.Log == nil {
+		return nopLogger{}
+	}
+	return g.Log
+}
+
+func (g *Gatherer) jobs() int {
+	if g.Jobs < 1 {
+		return 1
+	}
+	return g.Jobs
+}
+
+// Dependencies returns the sorted, deduplicated set of transitive shared library dependencies of binary.
+func (g *Gatherer) Dependencies(binary string) ([]Dep, error) {
+	paths, _, err := g.dependenciesRecursive(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := make([]Dep, len(paths))
+	for i, p := range paths {
+		deps[i] = Dep{Path: p}
+	}
+	return deps, nil
+}
+
+// Edge is a single (parent, child) NEEDED relationship discovered while walking the dependency graph.
+type Edge struct {
+	Parent string
+	Child  string
+}
+
+// DependencyGraph is like Dependencies, but also returns every (parent, child) edge discovered while
+// walking the dependency graph, for callers building a manifest.
+func (g *Gatherer) DependencyGraph(binary string) ([]Dep, []Edge, error) {
+	paths, edges, err := g.dependenciesRecursive(binary)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deps := make([]Dep, len(paths))
+	for i, p := range paths {
+		deps[i] = Dep{Path: p}
+	}
+	return deps, edges, nil
+}
+
+/* ############################################## */
+/* ###      Recursive Dependency Listing      ### */
+/* ############################################## */
+
+// dependenciesRecursive resolves the full transitive dependency set of file, expanding the BFS frontier
+// with up to g.jobs() workers running g.dependencies concurrently. The returned slice is sorted by path
+// so output stays reproducible regardless of worker scheduling.
+func (g *Gatherer) dependenciesRecursive(file string) ([]string, []Edge, error) {
+	open, err := g.dependencies(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var seen sync.Map
+	queue := newWorkQueue()
+	var inFlight int32
+
+	var mu sync.Mutex
+	edges := make([]Edge, 0)
+
+	for _, lib := range open {
+		seen.Store(lib, true)
+		atomic.AddInt32(&inFlight, 1)
+		queue.Push(lib)
+		edges = append(edges, Edge{Parent: file, Child: lib})
+	}
+
+	if len(open) == 0 {
+		// Nothing was seeded, so no worker will ever decrement inFlight to zero and close the queue.
+		queue.Close()
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	files := make([]string, 0)
+
+	for i := 0; i < g.jobs(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lib, ok := queue.Pop()
+				if !ok {
+					return
+				}
+
+				g.logger().Infof("-> Process %q", lib)
+
+				libs, err := g.dependencies(lib)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+				} else {
+					mu.Lock()
+					files = append(files, lib)
+					for _, dep := range libs {
+						edges = append(edges, Edge{Parent: lib, Child: dep})
+					}
+					mu.Unlock()
+
+					for _, dep := range libs {
+						if _, loaded := seen.LoadOrStore(dep, true); !loaded {
+							atomic.AddInt32(&inFlight, 1)
+							queue.Push(dep)
+						}
+					}
+				}
+
+				if atomic.AddInt32(&inFlight, -1) == 0 {
+					queue.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+
+	sort.Strings(files)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Parent != edges[j].Parent {
+			return edges[i].Parent < edges[j].Parent
+		}
+		return edges[i].Child < edges[j].Child
+	})
+	return files, edges, nil
+}
+
+func (g *Gatherer) dependencies(file string) ([]string, error) {
+	if g.depsFunc != nil {
+		return g.depsFunc(file)
+	}
+
+	switch g.Mode {
+	case ModeLDD:
+		return g.dependenciesLDD(file)
+
+	case ModeParse:
+		return g.dependenciesParse(file)
+
+	case ModeReadELF:
+		fallthrough
+	default:
+		return g.dependenciesReadELF(file)
+	}
+}
+
+func (g *Gatherer) dependenciesLDD(file string) ([]string, error) {
+	result, code, err := exec.Run("ldd", file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not execute 'ldd': %v", err)
+	}
+	if code != 0 {
+		g.logger().Infof(result)
+		return nil, fmt.Errorf("Code %d returned by 'ldd'", code)
+	}
+
+	pattern := regexp.MustCompile(`\s(` + patternLibName + `)(\s+=>\s+(` + patternLibPath + `))?\s+\(0x[0-9a-f]+\)`)
+	matches := pattern.FindAllStringSubmatch(result, -1)
+
+	files := make([]string, 0)
+	for _, m := range matches {
+		var depFile string
+		if len(m[3]) == 0 {
+			depFile = m[1]
+		} else {
+			depFile = m[3]
+		}
+
+		if strings.HasPrefix(depFile, "/") {
+			files = append(files, depFile)
+		}
+	}
+
+	return files, nil
+}
+
+func (g *Gatherer) dependenciesReadELF(file string) ([]string, error) {
+	result, code, err := exec.Run("readelf", "-d", file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not execute 'readelf': %v", err)
+	}
+	if code != 0 {
+		g.logger().Infof(result)
+		return nil, fmt.Errorf("Code %d returned by 'readelf'", code)
+	}
+
+	pattern := regexp.MustCompile(`0x\d+\s+\(NEEDED\)[^[]+\[(` + patternLibName + `)\]`)
+	matches := pattern.FindAllStringSubmatch(result, -1)
+
+	files := make([]string, 0)
+	for _, m := range matches {
+		libFile, err := g.findLibrary(m[1], file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find library file %q: %v", m[1], err)
+		}
+		files = append(files, libFile)
+	}
+
+	return files, nil
+}
+
+func (g *Gatherer) dependenciesParse(file string) ([]string, error) {
+	elfFile, err := g.openELF(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %q: %v", file, err)
+	}
+	defer elfFile.Close()
+
+	if elfFile.Section(".dynamic") == nil {
+		return nil, fmt.Errorf("No dynamic section in %q found. Probably statically linked", file)
+	}
+
+	needed, err := elfFile.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read DT_NEEDED of %q: %v", file, err)
+	}
+
+	files := make([]string, 0, len(needed))
+	for _, name := range needed {
+		path, err := g.findLibrary(name, file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find library file %q: %v", name, err)
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
+
+/* ############################################## */
+/* ###             Find Libraries             ### */
+/* ############################################## */
+
+func (g *Gatherer) findLibrary(name, callerFile string) (string, error) {
+	switch g.FindMode {
+	case FindModeSearch:
+		if g.Resolver == nil {
+			return "", fmt.Errorf("Find mode %q requires a Resolver", FindModeSearch)
+		}
+		return g.Resolver.FindLibrary(g.FS, g.MachineType, name, callerFile)
+
+	case FindModeLD:
+		fallthrough
+	default:
+		return g.findLibraryLDConfig(name)
+	}
+}
+
+func (g *Gatherer) findLibraryLDConfig(name string) (string, error) {
+	result, code, err := exec.Run("ldconfig", "-p")
+	if err != nil {
+		return "", fmt.Errorf("Could not execute 'ldconfig': %v", err)
+	}
+	if code != 0 {
+		g.logger().Infof(result)
+		return "", fmt.Errorf("Code %d returned by 'ldconfig'", code)
+	}
+
+	candidates := parseLdConfigOutput(result, name)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("Library %q not found in library cache", name)
+	}
+
+	return g.selectLibrary(name, candidates)
+}
+
+// parseLdConfigOutput extracts the candidate absolute paths for name from the output of 'ldconfig -p',
+// e.g. a line such as "\tlibc.so.6 (libc6,x86-64) => /lib/x86_64-linux-gnu/libc.so.6".
+func parseLdConfigOutput(result, name string) []string {
+	pattern := regexp.MustCompile(`([(` + patternLibName + `)\s+\([^)]+\)\s+=>\s+(` + patternLibPath + `)`)
+	matches := pattern.FindAllStringSubmatch(result, -1)
+
+	candidates := make([]string, 0)
+	for _, m := range matches {
+		if m[1] == name {
+			candidates = append(candidates, m[2])
+		}
+	}
+	return candidates
+}
+
+func (g *Gatherer) selectLibrary(name string, candidates []string) (string, error) {
+	for _, lib := range candidates {
+		libType, err := g.libraryMachineType(lib)
+		if err != nil {
+			return "", err
+		}
+		if libType == g.MachineType {
+			return lib, nil
+		}
+	}
+	return "", fmt.Errorf("Library %q not available for machine type %q", name, g.MachineType)
+}
+
+// LibraryMachineType returns the MachineType of the ELF file at path within the Gatherer's FS.
+func (g *Gatherer) LibraryMachineType(path string) (MachineType, error) {
+	return g.libraryMachineType(path)
+}
+
+func (g *Gatherer) libraryMachineType(path string) (MachineType, error) {
+	return readMachineType(g.FS, path)
+}
+
+func (g *Gatherer) openELF(path string) (*elf.File, error) {
+	return openELF(g.FS, path)
+}
+
+// readMachineType opens path as an ELF file through fsys and returns its MachineType.
+func readMachineType(fsys fs.FS, path string) (MachineType, error) {
+	elfFile, err := openELF(fsys, path)
+	if err != nil {
+		return MachineType{}, fmt.Errorf("Could not open ELF file %q: %v", path, err)
+	}
+	defer elfFile.Close()
+
+	return MachineType{
+		Class:   elfFile.Class,
+		Data:    elfFile.Data,
+		Machine: elfFile.Machine,
+		OSABI:   elfFile.OSABI,
+	}, nil
+}
+
+// openELF opens path as an ELF file through fsys, falling back to a direct read if fsys is unset (e.g.
+// when only the legacy LDD/ReadELF modes are used).
+func openELF(fsys fs.FS, path string) (*elf.File, error) {
+	if fsys == nil {
+		return elf.Open(path)
+	}
+
+	data, err := fs.ReadFile(fsys, toFSPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return elf.NewFile(bytes.NewReader(data))
+}
+
+// toFSPath turns an absolute host-style path into the slash-separated, rootless form required by io/fs.
+func toFSPath(path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// SymlinkFS is implemented by an fs.FS that can resolve a symlink without dereferencing it. Gatherer.FS
+// only needs to satisfy it for archive output to keep versioned SONAME symlinks (e.g. libfoo.so.1 ->
+// libfoo.so.1.2.3) instead of flattening them into a copy of the target's content; FS implementations that
+// don't satisfy it are treated as if no entry were ever a symlink.
+type SymlinkFS interface {
+	fs.FS
+	// Readlink returns the target of the symlink at name (an io/fs-style rootless path), or an error if
+	// name is not a symlink.
+	Readlink(name string) (string, error)
+}
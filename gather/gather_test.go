@@ -0,0 +1,58 @@
+package gather
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLdConfigOutput(t *testing.T) {
+	// Real 'ldconfig -p' output mixes 32-bit and 64-bit entries for the same library name.
+	const output = `1234 libs found in cache '/etc/ld.so.cache'
+	libc.so.6 (libc6,x86-64) => /lib/x86_64-linux-gnu/libc.so.6
+	libc.so.6 (libc6) => /lib/i386-linux-gnu/libc.so.6
+	libm.so.6 (libc6,x86-64) => /lib/x86_64-linux-gnu/libm.so.6
+`
+
+	candidates := parseLdConfigOutput(output, "libc.so.6")
+	want := []string{"/lib/x86_64-linux-gnu/libc.so.6", "/lib/i386-linux-gnu/libc.so.6"}
+	if len(candidates) != len(want) {
+		t.Fatalf("candidates = %v, want %v", candidates, want)
+	}
+	for i, c := range candidates {
+		if c != want[i] {
+			t.Errorf("candidates[%d] = %q, want %q", i, c, want[i])
+		}
+	}
+
+	if candidates := parseLdConfigOutput(output, "libssl.so.3"); len(candidates) != 0 {
+		t.Errorf("candidates for missing library = %v, want none", candidates)
+	}
+}
+
+// TestDependenciesRecursiveZeroDeps guards against the worker pool deadlocking when the root binary has no
+// dependencies of its own (e.g. a statically linked binary): with nothing seeded into the queue, no worker
+// ever decrements inFlight to zero, so the queue must be closed up front instead.
+func TestDependenciesRecursiveZeroDeps(t *testing.T) {
+	g := &Gatherer{
+		Jobs:     4,
+		depsFunc: func(file string) ([]string, error) { return nil, nil },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		files, edges, err := g.dependenciesRecursive("/bin/static")
+		if err != nil {
+			t.Errorf("dependenciesRecursive() error = %v", err)
+		}
+		if len(files) != 0 || len(edges) != 0 {
+			t.Errorf("dependenciesRecursive() = %v, %v, want empty", files, edges)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dependenciesRecursive() deadlocked on a zero-dependency root")
+	}
+}
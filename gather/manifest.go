@@ -0,0 +1,87 @@
+package gather
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// ManifestEntry describes a single gathered dependency, so a gathered bundle can be audited for
+// provenance without re-parsing every file.
+type ManifestEntry struct {
+	Path        string   `json:"path"`
+	SOName      string   `json:"soname,omitempty"`
+	Sha256      string   `json:"sha256"`
+	Machine     string   `json:"machine"`
+	Size        int64    `json:"size"`
+	RequestedBy []string `json:"requestedBy"`
+}
+
+// Manifest describes every dependency gathered for a binary, plus the edges of the dependency graph.
+type Manifest struct {
+	Binary       string          `json:"binary"`
+	Dependencies []ManifestEntry `json:"dependencies"`
+}
+
+// Manifest builds a Manifest for binary from deps and the edges of its dependency graph, as returned by
+// DependencyGraph. It reuses the edges of the BFS already performed there instead of resolving NEEDED entries
+// again; each dependency is still read once for its checksum, size, machine type and DT_SONAME.
+func (g *Gatherer) Manifest(binary string, deps []Dep, edges []Edge) (*Manifest, error) {
+	parents := make(map[string][]string)
+	for _, e := range edges {
+		parents[e.Child] = append(parents[e.Child], e.Parent)
+	}
+	for child := range parents {
+		sort.Strings(parents[child])
+	}
+
+	entries := make([]ManifestEntry, 0, len(deps))
+	for _, dep := range deps {
+		entry, err := g.manifestEntry(dep.Path, parents[dep.Path])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	return &Manifest{Binary: binary, Dependencies: entries}, nil
+}
+
+func (g *Gatherer) manifestEntry(path string, requestedBy []string) (ManifestEntry, error) {
+	f, err := g.FS.Open(toFSPath(path))
+	if err != nil {
+		return ManifestEntry{}, fmt.Errorf("Could not open %q: %v", path, err)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ManifestEntry{}, fmt.Errorf("Could not read %q: %v", path, err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	soname := ""
+	machine := MachineType{}
+	if elfFile, err := elf.NewFile(bytes.NewReader(data)); err == nil {
+		defer elfFile.Close()
+		machine = MachineType{Class: elfFile.Class, Data: elfFile.Data, Machine: elfFile.Machine, OSABI: elfFile.OSABI}
+		if names, err := elfFile.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+			soname = names[0]
+		}
+	}
+
+	return ManifestEntry{
+		Path:        path,
+		SOName:      soname,
+		Sha256:      hex.EncodeToString(sum[:]),
+		Machine:     machine.String(),
+		Size:        int64(len(data)),
+		RequestedBy: requestedBy,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package gather
+
+import "sync"
+
+// workQueue is an unbounded FIFO queue of library paths shared by the dependenciesRecursive workers.
+// Unlike a buffered channel it never blocks on Push, which matters here since workers both consume and
+// produce items while the queue is open.
+type workQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []string
+	closed bool
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push appends item to the queue and wakes a waiting worker.
+func (q *workQueue) Push(item string) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// Close signals that no more items will be pushed, waking all workers blocked in Pop.
+func (q *workQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// Pop removes and returns the next item, blocking until one is available. It returns ok == false once the
+// queue has been closed and drained.
+func (q *workQueue) Pop() (item string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return "", false
+	}
+
+	item, q.items = q.items[0], q.items[1:]
+	return item, true
+}
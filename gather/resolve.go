@@ -0,0 +1,383 @@
+package gather
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/* ############################################## */
+/* ###          Filesystem Dir Cache          ### */
+/* ############################################## */
+
+// dirEntry is a cached directory entry, keeping just enough information for library selection to tell
+// real files apart from directories without a second readdir.
+type dirEntry struct {
+	Name string
+	Mode fs.FileMode
+}
+
+// Cache memoizes directory listings, modeled after kati's fsCache, so a SearchResolver can answer "is
+// libX.so.6 in this dir?" from a cached listing instead of repeatedly re-reading the same directory. Entries
+// are keyed by (dev, ino) where the underlying fs.FS exposes it (as os.DirFS does), which folds together
+// directories reached through different symlinked paths (e.g. /lib -> /usr/lib); otherwise entries fall
+// back to being keyed by the resolved directory path.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string][]dirEntry
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{entries: make(map[string][]dirEntry)}
+}
+
+// ReadDir returns the cached listing of dir within fsys, populating the cache on first access.
+func (c *Cache) ReadDir(fsys fs.FS, dir string) ([]dirEntry, error) {
+	fsPath := toFSPath(dir)
+	key := cacheKey(fsys, fsPath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entries, ok := c.entries[key]; ok {
+		return entries, nil
+	}
+
+	list, err := fs.ReadDir(fsys, fsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, 0, len(list))
+	for _, e := range list {
+		entries = append(entries, dirEntry{Name: e.Name(), Mode: e.Type()})
+	}
+
+	c.entries[key] = entries
+	return entries, nil
+}
+
+// cacheKey identifies fsPath by (dev, ino) if fsys can produce a *syscall.Stat_t for it, falling back to
+// the path itself.
+func cacheKey(fsys fs.FS, fsPath string) string {
+	info, err := fs.Stat(fsys, fsPath)
+	if err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+		}
+	}
+	return fsPath
+}
+
+/* ############################################## */
+/* ###           Search Mode Resolver         ### */
+/* ############################################## */
+
+// SearchResolver resolves NEEDED entries the same way the glibc dynamic linker would, following
+// DT_RPATH/DT_RUNPATH, LD_LIBRARY_PATH, /etc/ld.so.conf and the default trusted directories. It implements
+// Resolver. A SearchResolver is safe to reuse across an entire gather run, or construct fresh (with a
+// fresh Cache) per test.
+type SearchResolver struct {
+	// Sysroot is prefixed to every absolute search directory, so a resolver can search a cross sysroot
+	// instead of the running host's own library layout.
+	Sysroot string
+	// LDLibraryPath is the ':' separated list searched in place of LD_LIBRARY_PATH. The resolver itself
+	// never reads the environment; NewSearchResolver fills this from LD_LIBRARY_PATH when given "".
+	LDLibraryPath string
+	// Cache memoizes directory listings. It must not be nil; NewSearchResolver creates a fresh one when
+	// passed nil.
+	Cache *Cache
+}
+
+// NewSearchResolver creates a SearchResolver rooted at sysroot ("/" for the host). ldLibraryPath takes
+// precedence, falling back to the LD_LIBRARY_PATH environment variable when empty, so a binary that relies
+// on an ambient LD_LIBRARY_PATH is still found without the caller having to re-specify it. cache may be nil
+// to create a fresh one.
+func NewSearchResolver(sysroot, ldLibraryPath string, cache *Cache) *SearchResolver {
+	if cache == nil {
+		cache = NewCache()
+	}
+	if ldLibraryPath == "" {
+		ldLibraryPath = os.Getenv("LD_LIBRARY_PATH")
+	}
+	return &SearchResolver{Sysroot: sysroot, LDLibraryPath: ldLibraryPath, Cache: cache}
+}
+
+// FindLibrary implements Resolver.
+func (r *SearchResolver) FindLibrary(fsys fs.FS, machine MachineType, name, callerFile string) (string, error) {
+	dirs, err := r.buildSearchPath(fsys, machine, callerFile)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := make([]string, 0)
+	for _, dir := range dirs {
+		candidates = append(candidates, r.candidatesInDir(fsys, dir, name)...)
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("Library %q not found in search path", name)
+	}
+
+	for _, candidate := range candidates {
+		libType, err := readMachineType(fsys, candidate)
+		if err != nil {
+			return "", err
+		}
+		if libType == machine {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("Library %q not available for machine type %q", name, machine)
+}
+
+// candidatesInDir returns the paths of every dirent named name in dir, skipping dangling symlinks and
+// directories.
+func (r *SearchResolver) candidatesInDir(fsys fs.FS, dir, name string) []string {
+	entries, err := r.Cache.ReadDir(fsys, dir)
+	if err != nil {
+		return nil
+	}
+
+	candidates := make([]string, 0)
+	for _, e := range entries {
+		if e.Name != name || e.Mode.IsDir() {
+			continue
+		}
+		candidatePath := path.Join(dir, e.Name)
+		if _, err := fs.Stat(fsys, toFSPath(candidatePath)); err != nil {
+			continue // dangling symlink or otherwise unreadable
+		}
+		candidates = append(candidates, candidatePath)
+	}
+	return candidates
+}
+
+func (r *SearchResolver) buildSearchPath(fsys fs.FS, machine MachineType, callerFile string) ([]string, error) {
+	rpath, runpath, err := dynamicPaths(fsys, callerFile)
+	if err != nil {
+		return nil, err
+	}
+
+	confDirs, err := parseLdSoConf(fsys, path.Join(r.Sysroot, "etc/ld.so.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := mergeSearchDirs(rpath, runpath, r.LDLibraryPath, confDirs, defaultTrustedDirs(machine))
+
+	result := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		dir = expandDynamicTokens(dir, machine, callerFile)
+		if !path.IsAbs(dir) {
+			continue
+		}
+		result = append(result, path.Join(r.Sysroot, dir))
+	}
+	return result, nil
+}
+
+// mergeSearchDirs assembles the ordered library search path the glibc dynamic linker uses: DT_RPATH (only
+// when DT_RUNPATH is absent, per ld.so(8)), then LD_LIBRARY_PATH, then DT_RUNPATH, then the directories
+// listed in ld.so.conf, then the default trusted directories.
+func mergeSearchDirs(rpath, runpath []string, ldLibraryPath string, confDirs, trustedDirs []string) []string {
+	dirs := make([]string, 0)
+	if len(runpath) == 0 {
+		dirs = append(dirs, rpath...)
+	}
+
+	if len(ldLibraryPath) > 0 {
+		dirs = append(dirs, strings.Split(ldLibraryPath, ":")...)
+	}
+
+	dirs = append(dirs, runpath...)
+	dirs = append(dirs, confDirs...)
+	dirs = append(dirs, trustedDirs...)
+	return dirs
+}
+
+// dynamicPaths reads the DT_RPATH and DT_RUNPATH entries of file within fsys, already split on ':'.
+func dynamicPaths(fsys fs.FS, file string) (rpath, runpath []string, err error) {
+	elfFile, err := openELF(fsys, file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open ELF file %q: %v", file, err)
+	}
+	defer elfFile.Close()
+
+	rpathEntries, err := elfFile.DynString(elf.DT_RPATH)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read DT_RPATH of %q: %v", file, err)
+	}
+	for _, e := range rpathEntries {
+		rpath = append(rpath, strings.Split(e, ":")...)
+	}
+
+	runpathEntries, err := elfFile.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read DT_RUNPATH of %q: %v", file, err)
+	}
+	for _, e := range runpathEntries {
+		runpath = append(runpath, strings.Split(e, ":")...)
+	}
+
+	return rpath, runpath, nil
+}
+
+// expandDynamicTokens replaces the dynamic-linker tokens $ORIGIN, $LIB and $PLATFORM (and their braced
+// forms) in a DT_RPATH/DT_RUNPATH entry, as documented in ld.so(8).
+func expandDynamicTokens(entry string, machine MachineType, callerFile string) string {
+	origin := path.Dir(callerFile)
+
+	lib := "lib"
+	if machine.Class == elf.ELFCLASS64 {
+		lib = "lib64"
+	}
+
+	platform := platformName(machine)
+
+	replacer := strings.NewReplacer(
+		"$ORIGIN", origin, "${ORIGIN}", origin,
+		"$LIB", lib, "${LIB}", lib,
+		"$PLATFORM", platform, "${PLATFORM}", platform,
+	)
+	return replacer.Replace(entry)
+}
+
+// parseLdSoConf parses an /etc/ld.so.conf style file within fsys, recursively following "include"
+// directives (including glob patterns such as "/etc/ld.so.conf.d/*.conf"), so FindModeSearch can resolve
+// against any fs.FS instead of assuming host '/etc' access.
+func parseLdSoConf(fsys fs.FS, confPath string) ([]string, error) {
+	return parseLdSoConfRecursive(fsys, confPath, make(map[string]bool))
+}
+
+func parseLdSoConfRecursive(fsys fs.FS, confPath string, visited map[string]bool) ([]string, error) {
+	if visited[confPath] {
+		return nil, nil
+	}
+	visited[confPath] = true
+
+	data, err := fs.ReadFile(fsys, toFSPath(confPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read %q: %v", confPath, err)
+	}
+
+	dirs := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "include ") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include"))
+			if !path.IsAbs(pattern) {
+				pattern = path.Join(path.Dir(confPath), pattern)
+			}
+			matches, err := fs.Glob(fsys, toFSPath(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid include pattern %q in %q: %v", pattern, confPath, err)
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				sub, err := parseLdSoConfRecursive(fsys, "/"+match, visited)
+				if err != nil {
+					return nil, err
+				}
+				dirs = append(dirs, sub...)
+			}
+			continue
+		}
+
+		dirs = append(dirs, line)
+	}
+	return dirs, nil
+}
+
+// defaultTrustedDirs returns the directories ld.so searches when no ld.so.conf entry applies. /lib64 and
+// /usr/lib64 only exist for 64-bit machine types, but the Debian multiarch directory is added for any
+// machine type with a known triplet, 32-bit ones (e.g. armhf) included.
+func defaultTrustedDirs(machine MachineType) []string {
+	dirs := []string{"/lib", "/usr/lib"}
+
+	if machine.Class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+
+	if triplet := multiarchTriplet(machine); len(triplet) > 0 {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+
+	return dirs
+}
+
+// multiarchTriplet returns the Debian multiarch triplet for machine, or an empty string if unknown.
+// EM_PPC64 and EM_MIPS are shared by the big- and little-endian variants, so those branch on machine.Data.
+func multiarchTriplet(machine MachineType) string {
+	switch machine.Machine {
+	case elf.EM_X86_64:
+		return "x86_64-linux-gnu"
+	case elf.EM_AARCH64:
+		return "aarch64-linux-gnu"
+	case elf.EM_ARM:
+		return "arm-linux-gnueabihf"
+	case elf.EM_PPC64:
+		if machine.Data == elf.ELFDATA2MSB {
+			return "powerpc64-linux-gnu"
+		}
+		return "powerpc64le-linux-gnu"
+	case elf.EM_RISCV:
+		return "riscv64-linux-gnu"
+	case elf.EM_S390:
+		return "s390x-linux-gnu"
+	case elf.EM_MIPS:
+		// Only the 64-bit triplets are known here; 32-bit MIPS has no match.
+		if machine.Class != elf.ELFCLASS64 {
+			return ""
+		}
+		if machine.Data == elf.ELFDATA2MSB {
+			return "mips64-linux-gnuabi64"
+		}
+		return "mips64el-linux-gnuabi64"
+	default:
+		return ""
+	}
+}
+
+// platformName returns the $PLATFORM dynamic-linker token value for machine. EM_PPC64 and EM_MIPS are
+// shared by the big- and little-endian variants, so those branch on machine.Data.
+func platformName(machine MachineType) string {
+	switch machine.Machine {
+	case elf.EM_X86_64:
+		return "x86_64"
+	case elf.EM_AARCH64:
+		return "aarch64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_PPC64:
+		if machine.Data == elf.ELFDATA2MSB {
+			return "ppc64"
+		}
+		return "ppc64le"
+	case elf.EM_RISCV:
+		return "riscv64"
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_MIPS:
+		if machine.Data == elf.ELFDATA2MSB {
+			return "mips64"
+		}
+		return "mips64el"
+	default:
+		return ""
+	}
+}
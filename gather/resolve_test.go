@@ -0,0 +1,73 @@
+package gather
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMergeSearchDirs(t *testing.T) {
+	trusted := []string{"/lib", "/usr/lib"}
+
+	t.Run("RPATH used only without RUNPATH", func(t *testing.T) {
+		got := mergeSearchDirs([]string{"/rpath"}, nil, "", nil, trusted)
+		want := []string{"/rpath", "/lib", "/usr/lib"}
+		assertStringSlicesEqual(t, got, want)
+	})
+
+	t.Run("RUNPATH present suppresses RPATH", func(t *testing.T) {
+		got := mergeSearchDirs([]string{"/rpath"}, []string{"/runpath"}, "", nil, trusted)
+		want := []string{"/runpath", "/lib", "/usr/lib"}
+		assertStringSlicesEqual(t, got, want)
+	})
+
+	t.Run("full ordering with RUNPATH: LD_LIBRARY_PATH, RUNPATH, conf, trusted", func(t *testing.T) {
+		got := mergeSearchDirs(nil, []string{"/runpath"}, "/ld1:/ld2", []string{"/conf"}, trusted)
+		want := []string{"/ld1", "/ld2", "/runpath", "/conf", "/lib", "/usr/lib"}
+		assertStringSlicesEqual(t, got, want)
+	})
+}
+
+func assertStringSlicesEqual(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// countingFS wraps an fs.FS, counting calls to ReadDir, so tests can assert on Cache's memoization.
+type countingFS struct {
+	fs.FS
+	reads int
+}
+
+func (c *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.reads++
+	return fs.ReadDir(c.FS, name)
+}
+
+func TestCacheReadDirMemoizes(t *testing.T) {
+	fsys := &countingFS{FS: fstest.MapFS{
+		"lib/libfoo.so.1": &fstest.MapFile{},
+	}}
+	c := NewCache()
+
+	for i := 0; i < 3; i++ {
+		entries, err := c.ReadDir(fsys, "/lib")
+		if err != nil {
+			t.Fatalf("ReadDir() error = %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name != "libfoo.so.1" {
+			t.Fatalf("ReadDir() = %v, want [libfoo.so.1]", entries)
+		}
+	}
+
+	if fsys.reads != 1 {
+		t.Errorf("underlying ReadDir called %d times, want 1 (cached)", fsys.reads)
+	}
+}
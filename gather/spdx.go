@@ -0,0 +1,123 @@
+package gather
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SPDXDocument is a minimal SPDX 2.3 document describing a Manifest, so a gathered bundle can be
+// distributed with basic license/provenance metadata attached.
+type SPDXDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+// SPDXCreationInfo records who/when created the document.
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// SPDXPackage is a minimal SPDX package entry, one per gathered dependency.
+type SPDXPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []SPDXChecksum `json:"checksums,omitempty"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+// SPDXChecksum is a single package checksum.
+type SPDXChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// SPDXRelationship links two SPDX elements, e.g. "package A DEPENDS_ON package B".
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SPDX builds a minimal SPDX 2.3 document from a Manifest: one package per dependency plus the root
+// binary, and a DEPENDS_ON relationship for every edge the manifest recorded.
+func SPDX(m *Manifest) *SPDXDocument {
+	rootName := filepath.Base(m.Binary)
+	rootID := "SPDXRef-" + spdxElementID(rootName)
+
+	doc := &SPDXDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              rootName + "-dependencies",
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/%s-%d", rootName, time.Now().UnixNano()),
+		CreationInfo: SPDXCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: gather-dependencies"},
+		},
+	}
+
+	doc.Packages = append(doc.Packages, SPDXPackage{
+		SPDXID:           rootID,
+		Name:             rootName,
+		DownloadLocation: "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+	})
+	doc.Relationships = append(doc.Relationships, SPDXRelationship{
+		SPDXElementID:      doc.SPDXID,
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: rootID,
+	})
+
+	for _, dep := range m.Dependencies {
+		id := "SPDXRef-" + spdxElementID(dep.Path)
+
+		pkg := SPDXPackage{
+			SPDXID:           id,
+			Name:             filepath.Base(dep.Path),
+			DownloadLocation: "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		if len(dep.Sha256) > 0 {
+			pkg.Checksums = []SPDXChecksum{{Algorithm: "SHA256", ChecksumValue: dep.Sha256}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+
+		for _, parent := range dep.RequestedBy {
+			parentID := rootID
+			if parent != m.Binary {
+				parentID = "SPDXRef-" + spdxElementID(parent)
+			}
+			doc.Relationships = append(doc.Relationships, SPDXRelationship{
+				SPDXElementID:      parentID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: id,
+			})
+		}
+	}
+
+	return doc
+}
+
+// spdxElementID turns name into a valid SPDX identifier suffix (letters, digits, '.' and '-' only).
+func spdxElementID(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
@@ -1,48 +1,40 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"runtime"
+	"strconv"
 
 	"github.com/alecthomas/kingpin"
 	nested "github.com/antonfisher/nested-logrus-formatter"
-	"github.com/sbreitf1/exec"
-	"github.com/sbreitf1/fs"
 	log "github.com/sirupsen/logrus"
-	elf "github.com/yalue/elf_reader"
-)
-
-const (
-	modeLDD     = "LDD"
-	modeReadELF = "ReadELF"
-	modeParse   = "Parse"
-
-	findModeLD     = "LD"
-	findModeSearch = "Search"
-
-	machineTypeUnknown = ""
-	machineTypeX86     = "x86"
-	machineTypeAMD64   = "x86-64"
 
-	patternLibName = "[a-zA-Z0-9.\\-_+]+"
-	patternLibPath = "[a-zA-Z0-9.\\-_+/]+"
+	"github.com/sbreitf1/gather-dependencies/gather"
 )
 
 var (
 	appMain      = kingpin.New("gather-dependencies", "Copy all shared dependencies into a single directory")
 	argInputFile = appMain.Arg("in", "Input binary file").Required().String()
-	argOutputDir = appMain.Arg("out", "Output directory").Required().String()
-
-	clean       = appMain.Flag("clean", "Delete all files from output directory").Bool()
-	mode        = appMain.Flag("mode", "Mode can be one of '"+modeLDD+"', '"+modeReadELF+"' or '"+modeParse+"'.").Short('m').Default(modeReadELF).String()
-	findMode    = appMain.Flag("findmode", "Find mode can be one of '"+findModeLD+"' or '"+findModeSearch+"'.").Short('f').Default(findModeLD).String()
-	machineType = machineTypeUnknown
+	argOutputDir = appMain.Arg("out", "Output directory, or archive file path when --format is not '"+string(gather.FormatDir)+"'").Required().String()
+
+	clean         = appMain.Flag("clean", "Delete all files from output directory. Only used with --format="+string(gather.FormatDir)+".").Bool()
+	mode          = appMain.Flag("mode", "Mode can be one of '"+string(gather.ModeLDD)+"', '"+string(gather.ModeReadELF)+"' or '"+string(gather.ModeParse)+"'.").Short('m').Default(string(gather.ModeReadELF)).String()
+	findMode      = appMain.Flag("findmode", "Find mode can be one of '"+string(gather.FindModeLD)+"' or '"+string(gather.FindModeSearch)+"'.").Short('f').Default(string(gather.FindModeLD)).String()
+	sysroot       = appMain.Flag("sysroot", "Prefix applied to every absolute library search directory. Only used in find mode '"+string(gather.FindModeSearch)+"'.").Default("/").String()
+	ldLibraryPath = appMain.Flag("ld-library-path", "Additional ':' separated library search paths. Defaults to the LD_LIBRARY_PATH environment variable. Only used in find mode '"+string(gather.FindModeSearch)+"'.").Envar("LD_LIBRARY_PATH").String()
+	jobs          = appMain.Flag("jobs", "Number of dependencies to resolve concurrently.").Short('j').Default(strconv.Itoa(runtime.NumCPU())).Int()
+	format        = appMain.Flag("format", "Output format. One of '"+string(gather.FormatDir)+"', '"+string(gather.FormatTar)+"', '"+string(gather.FormatTarGz)+"', '"+string(gather.FormatCPIO)+"' or '"+string(gather.FormatOCILayer)+"'. Every format but '"+string(gather.FormatDir)+"' writes 'out' as a single archive file instead of a directory.").Default(string(gather.FormatDir)).String()
+	manifestPath  = appMain.Flag("manifest", "Write a manifest describing every gathered dependency to this path.").String()
+	manifestFmt   = appMain.Flag("manifest-format", "Manifest format, either 'json' or 'spdx'.").Default("json").String()
 )
 
+// main is a thin CLI wrapper around the gather package, wiring it up against the host filesystem.
 func main() {
 	log.SetFormatter(&nested.Formatter{
 		HideKeys:        true,
@@ -57,361 +49,170 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid input file: %v", err)
 	}
-	outputDir, err := filepath.Abs(*argOutputDir)
+	outputPath, err := filepath.Abs(*argOutputDir)
 	if err != nil {
-		log.Fatalf("Invalid output dir: %v", err)
+		log.Fatalf("Invalid output path: %v", err)
 	}
 
 	log.Infof("Input file %q", inputFile)
-	machineType, err = getLibraryMachineType(inputFile)
-	if err != nil {
-		log.Fatalf("Unable to detect binary machine type: %v", err)
-	}
-	if machineType == machineTypeUnknown {
-		log.Fatalf("Unknown binary machine type")
-	}
-	log.Infof("-> Machine Type %s", machineType)
-	log.Infof("Output dir %q", outputDir)
 
-	if *clean {
-		log.Infof("Clean output directory")
-		files, err := ioutil.ReadDir(outputDir)
-		if err != nil {
-			log.Fatalf("Failed to clean output directory")
-		}
-		for _, file := range files {
-			path := filepath.Join(outputDir, file.Name())
-			if file.IsDir() {
-				if err := os.RemoveAll(path); err != nil {
-					log.Fatalf("Failed to delete directory %q", path)
-				}
-			} else {
-				if err := os.Remove(filepath.Join(outputDir, file.Name())); err != nil {
-					log.Fatalf("Failed to delete file %q", path)
-				}
-			}
-		}
+	g := &gather.Gatherer{
+		Mode:     gather.Mode(*mode),
+		FindMode: gather.FindMode(*findMode),
+		FS:       osSymlinkFS{root: "/"},
+		Resolver: gather.NewSearchResolver(*sysroot, *ldLibraryPath, gather.NewCache()),
+		Log:      log.StandardLogger(),
+		Jobs:     *jobs,
 	}
 
-	files, err := getAllDependencies(inputFile)
+	targetMachine, err := g.LibraryMachineType(inputFile)
 	if err != nil {
-		log.Fatalf("Could not retrieve dependencies: %v", err)
-	}
-
-	log.Infof("Copy dependencies to output dir")
-	for _, file := range files {
-		log.Infof("-> Gather file %q", file)
-
-		dstFile := filepath.Join(outputDir, file)
-		dstDir := filepath.Dir(dstFile)
-		if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
-			log.Fatalf("Could not create parent directory: %v", err)
-		}
-
-		if err := fs.CopyFile(file, dstFile); err != nil {
-			log.Fatalf("Failed to copy file: %v", err)
-		}
+		log.Fatalf("Unable to detect binary machine type: %v", err)
 	}
+	g.MachineType = targetMachine
+	log.Infof("-> Machine Type %s", targetMachine)
+	log.Infof("Output %q", outputPath)
 
-	log.Infof("%d dependencies have been gathered", len(files))
-}
-
-/* ############################################## */
-/* ###           Dependency Listing           ### */
-/* ############################################## */
-
-func getAllDependencies(file string) ([]string, error) {
 	log.Infof("Retrieve dependencies")
-
-	switch *mode {
-	case modeLDD:
-		return getDependenciesRecursiveLDD(file)
-
-	case modeReadELF:
-		fallthrough
-	case modeParse:
-		return getDependenciesRecursive(file)
-
-	default:
-		return nil, fmt.Errorf("Invalid mode %q", *mode)
-	}
-}
-
-func getDependenciesRecursiveLDD(file string) ([]string, error) {
-	result, code, err := exec.Run("ldd", file)
+	deps, edges, err := g.DependencyGraph(inputFile)
 	if err != nil {
-		return nil, fmt.Errorf("Could not execute 'ldd': %v", err)
-	}
-	if code != 0 {
-		log.Info(result)
-		return nil, fmt.Errorf("Code %d returned by 'ldd'", code)
+		log.Fatalf("Could not retrieve dependencies: %v", err)
 	}
 
-	pattern := regexp.MustCompile(`\s(` + patternLibName + `)(\s+=>\s+(` + patternLibPath + `))?\s+\(0x[0-9a-f]+\)`)
-	matches := pattern.FindAllStringSubmatch(result, -1)
-
-	files := make([]string, 0)
-	for _, m := range matches {
-		var depFile string
-		if len(m[3]) == 0 {
-			depFile = m[1]
-		} else {
-			depFile = m[3]
-		}
+	if err := writeOutput(g, deps, gather.Format(*format), outputPath); err != nil {
+		log.Fatalf("%v", err)
+	}
 
-		if strings.HasPrefix(depFile, "/") {
-			files = append(files, depFile)
+	if len(*manifestPath) > 0 {
+		if err := writeManifest(g, inputFile, deps, edges, *manifestPath, *manifestFmt); err != nil {
+			log.Fatalf("%v", err)
 		}
 	}
 
-	return files, nil
+	log.Infof("%d dependencies have been gathered", len(deps))
 }
 
-/* ############################################## */
-/* ###      Recursive Dependency Listing      ### */
-/* ############################################## */
+// writeManifest builds a dependency manifest for binary and writes it to path, either as the native JSON
+// manifest or, when format is "spdx", as a minimal SPDX 2.3 document.
+func writeManifest(g *gather.Gatherer, binary string, deps []gather.Dep, edges []gather.Edge, path, format string) error {
+	log.Infof("Write %s manifest to %q", format, path)
 
-func getDependenciesRecursive(file string) ([]string, error) {
-	open, err := getDependencies(file)
+	manifest, err := g.Manifest(binary, deps, edges)
 	if err != nil {
-		return nil, err
-	}
-	seen := make(map[string]bool)
-	for _, lib := range open {
-		seen[lib] = true
+		return fmt.Errorf("Could not build manifest: %v", err)
 	}
 
-	files := make([]string, 0)
-	for len(open) > 0 {
-		lib := open[0]
-		open = open[1:]
-
-		log.Infof("-> Process %q", lib)
-
-		libs, err := getDependencies(lib)
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, lib)
-
-		for _, lib := range libs {
-			if _, ok := seen[lib]; !ok {
-				open = append(open, lib)
-				seen[lib] = true
-			}
-		}
-	}
-
-	return files, nil
-}
-
-func getDependencies(file string) ([]string, error) {
-	switch *mode {
-	case modeReadELF:
-		return getDependenciesReadELF(file)
-
-	case modeParse:
-		return getDependenciesParse(file)
-
+	var data []byte
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(manifest, "", "  ")
+	case "spdx":
+		data, err = json.MarshalIndent(gather.SPDX(manifest), "", "  ")
 	default:
-		return nil, fmt.Errorf("Invalid mode %q", *mode)
+		return fmt.Errorf("Invalid manifest format %q", format)
 	}
-}
-
-func getDependenciesReadELF(file string) ([]string, error) {
-	result, code, err := exec.Run("readelf", "-d", file)
 	if err != nil {
-		return nil, fmt.Errorf("Could not execute 'ldd': %v", err)
-	}
-	if code != 0 {
-		log.Info(result)
-		return nil, fmt.Errorf("Code %d returned by 'ldd'", code)
-	}
-
-	pattern := regexp.MustCompile(`0x\d+\s+\(NEEDED\)[^[]+\[(` + patternLibName + `)\]`)
-	matches := pattern.FindAllStringSubmatch(result, -1)
-
-	files := make([]string, 0)
-	for _, m := range matches {
-		file, err := findLibrary(m[1])
-		if err != nil {
-			return nil, fmt.Errorf("Could not find library file %q: %v", m[1], err)
-		}
-		files = append(files, file)
+		return fmt.Errorf("Could not encode manifest: %v", err)
 	}
 
-	return files, nil
+	return ioutil.WriteFile(path, data, 0644)
 }
 
-func getDependenciesParse(file string) ([]string, error) {
-	raw, err := ioutil.ReadFile(file)
-	if err != nil {
-		panic(err)
+// writeOutput writes deps to outputPath in the given format, either as a directory tree or as a single
+// archive file.
+func writeOutput(g *gather.Gatherer, deps []gather.Dep, f gather.Format, outputPath string) error {
+	if f == gather.FormatDir {
+		return writeDir(g, deps, outputPath)
 	}
-	elfFile, err := elf.ParseELFFile(raw)
+
+	out, err := os.Create(outputPath)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Could not create output file %q: %v", outputPath, err)
 	}
+	defer out.Close()
 
-	count := elfFile.GetSectionCount()
+	switch f {
+	case gather.FormatTar:
+		log.Infof("Write tar archive to %q", outputPath)
+		return g.WriteTar(deps, out)
 
-	// find dynamic section
-	dynSection := uint16(0)
-	for i := uint16(1); i < count; i++ {
-		name, err := elfFile.GetSectionName(i)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to parse %q: %v", file, err)
-		}
-		if name == ".dynamic" {
-			dynSection = i
-			break
-		}
-	}
+	case gather.FormatTarGz:
+		log.Infof("Write tar.gz archive to %q", outputPath)
+		return g.WriteTarGz(deps, out)
 
-	if dynSection == uint16(0) {
-		return nil, fmt.Errorf("No dynamic section in %q found. Probably statically linked", file)
-	}
+	case gather.FormatCPIO:
+		log.Infof("Write cpio archive to %q", outputPath)
+		return g.WriteCPIO(deps, out)
 
-	// find dynamic string section
-	dynStrSection := uint16(0)
-	for i := uint16(1); i < count; i++ {
-		name, err := elfFile.GetSectionName(i)
+	case gather.FormatOCILayer:
+		log.Infof("Write OCI layer to %q", outputPath)
+		descriptor, err := g.WriteOCILayer(deps, out)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to parse %q: %v", file, err)
-		}
-		if name == ".dynstr" {
-			dynStrSection = i
-			break
+			return err
 		}
-	}
+		return writeLayerManifest(descriptor, filepath.Join(filepath.Dir(outputPath), "layer.json"))
 
-	if dynStrSection == uint16(0) {
-		return nil, fmt.Errorf("No dynamic strings section in %q found. Probably statically linked", file)
-	}
-
-	entries, err := elfFile.DynamicEntries(dynSection)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse %q: %v", file, err)
-	}
-	data, err := elfFile.GetSectionContent(dynStrSection)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse %q: %v", file, err)
+	default:
+		return fmt.Errorf("Invalid format %q", f)
 	}
+}
 
-	files := make([]string, 0)
-	for _, entry := range entries {
-		// NEEDED flag (1)
-		if entry.GetTag().GetValue() == 1 {
-			start := entry.GetValue()
-			end := start
-			for ; end < uint64(len(data)); end++ {
-				if data[end] == 0 {
-					break
+func writeDir(g *gather.Gatherer, deps []gather.Dep, outputDir string) error {
+	if *clean {
+		log.Infof("Clean output directory")
+		files, err := ioutil.ReadDir(outputDir)
+		if err != nil {
+			return fmt.Errorf("Failed to clean output directory: %v", err)
+		}
+		for _, file := range files {
+			path := filepath.Join(outputDir, file.Name())
+			if file.IsDir() {
+				if err := os.RemoveAll(path); err != nil {
+					return fmt.Errorf("Failed to delete directory %q: %v", path, err)
+				}
+			} else {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("Failed to delete file %q: %v", path, err)
 				}
 			}
-			str := string(data[start:end])
-			path, err := findLibrary(str)
-			if err != nil {
-				return nil, fmt.Errorf("Could not find library file %q: %v", str, err)
-			}
-			files = append(files, path)
 		}
 	}
 
-	return files, nil
-}
-
-/* ############################################## */
-/* ###             Find Libraries             ### */
-/* ############################################## */
-
-func findLibrary(name string) (string, error) {
-	switch *findMode {
-	case findModeLD:
-		return findLibraryLDConfig(name)
-
-	case findModeSearch:
-		return "", fmt.Errorf("Find mode %q is not implemented yet", findModeSearch)
-
-	default:
-		return "", fmt.Errorf("Invalid find mode %q", *findMode)
-	}
+	log.Infof("Copy dependencies to output dir")
+	return g.Copy(deps, osWritableFS{root: outputDir})
 }
 
-func findLibraryLDConfig(name string) (string, error) {
-	result, code, err := exec.Run("ldconfig", "-p")
+func writeLayerManifest(descriptor *gather.OCILayerDescriptor, path string) error {
+	data, err := json.MarshalIndent(descriptor, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("Could not execute 'ldconfig': %v", err)
-	}
-	if code != 0 {
-		log.Info(result)
-		return "", fmt.Errorf("Code %d returned by 'ldconfig'", code)
-	}
-
-	pattern := regexp.MustCompile(`([(` + patternLibName + `)\s+\([^)]+\)\s+=>\s+(` + patternLibPath + `)`)
-	matches := pattern.FindAllStringSubmatch(result, -1)
-
-	candidates := make([]string, 0)
-	for _, m := range matches {
-		if m[1] == name {
-			candidates = append(candidates, m[2])
-		}
+		return fmt.Errorf("Could not encode layer manifest: %v", err)
 	}
+	return ioutil.WriteFile(path, data, 0644)
+}
 
-	if len(candidates) == 0 {
-		return "", fmt.Errorf("Library %q not found in library cache", name)
-	}
+// osWritableFS implements gather.WritableFS by writing files below root on the host filesystem.
+type osWritableFS struct {
+	root string
+}
 
-	return selectLibrary(name, candidates)
+func (o osWritableFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(filepath.Join(o.root, path), perm)
 }
 
-func selectLibrary(name string, candidates []string) (string, error) {
-	for _, lib := range candidates {
-		libType, err := getLibraryMachineType(lib)
-		if err != nil {
-			return "", err
-		}
-		if libType == machineType {
-			return lib, nil
-		}
-	}
-	return "", fmt.Errorf("Library %q not available for machine type %q", name, machineType)
+func (o osWritableFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(o.root, name))
 }
 
-func getLibraryMachineType(path string) (string, error) {
-	raw, err := ioutil.ReadFile(path)
-	if err != nil {
-		panic(err)
-	}
-	elfFile, err := elf.ParseELFFile(raw)
-	if err != nil {
-		panic(err)
-	}
+// osSymlinkFS implements gather.SymlinkFS by reading files, and resolving symlinks, below root on the host
+// filesystem.
+type osSymlinkFS struct {
+	root string
+}
 
-	switch elfFile.(type) {
-	case *elf.ELF32File:
-		/*switch e.Header.Machine {
-		case elf.MachineTypeX86:
-			return machineTypeX86, nil
-		default:
-			log.Warnf("Unknown machine type %q of %q", e.Header.Machine, path)
-			return machineTypeUnknown, nil
-		}*/
-		return machineTypeX86, nil
-
-	case *elf.ELF64File:
-		/*switch e.Header.Machine {
-		case elf.MachineTypeAMD64:
-			return machineTypeAMD64, nil
-		default:
-			log.Warnf("Unknown machine type %q of %q", e.Header.Machine, path)
-			return machineTypeUnknown, nil
-		}*/
-		return machineTypeAMD64, nil
+func (o osSymlinkFS) Open(name string) (fs.File, error) {
+	return os.DirFS(o.root).Open(name)
+}
 
-	default:
-		// ignore unknown architectures
-		log.Warnf("Unknown ELF Type %T", elfFile)
-		return machineTypeUnknown, nil
-	}
+func (o osSymlinkFS) Readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(o.root, name))
 }